@@ -21,6 +21,7 @@ limitations under the License.
 package reversetunnel
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -51,6 +52,15 @@ type Agent struct {
 	conn            ssh.Conn
 	hostKeyCallback utils.HostKeyCallback
 	authMethods     []ssh.AuthMethod
+	l3CIDR          string
+	l3IfaceName     string
+
+	// mu guards heartbeatPeriod, which is updated from the control stream,
+	// and openTransports, which is updated from the transport goroutines;
+	// the control stream reads both.
+	mu              sync.Mutex
+	heartbeatPeriod time.Duration
+	openTransports  int32
 }
 
 // AgentOption specifies parameter that could be passed to Agents
@@ -73,12 +83,13 @@ func NewAgent(addr utils.NetAddr, domainName string, signers []ssh.Signer,
 			"module": "agent",
 			"remote": addr,
 		}),
-		clt:         clt,
-		addr:        addr,
-		domainName:  domainName,
-		waitC:       make(chan bool),
-		disconnectC: make(chan bool, 10),
-		authMethods: []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		clt:             clt,
+		addr:            addr,
+		domainName:      domainName,
+		waitC:           make(chan bool),
+		disconnectC:     make(chan bool, 10),
+		authMethods:     []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		heartbeatPeriod: defaultHeartbeatPeriod,
 	}
 	a.hostKeyCallback = a.checkHostSignature
 	for _, o := range options {
@@ -111,6 +122,7 @@ func NewHangoutAgent(addr utils.NetAddr, hangoutID string,
 		disconnectC:     make(chan bool, 10),
 		authMethods:     authMethods,
 		hostKeyCallback: hostKeyCallback,
+		heartbeatPeriod: defaultHeartbeatPeriod,
 	}
 	for _, o := range options {
 		if err := o(a); err != nil {
@@ -123,34 +135,46 @@ func NewHangoutAgent(addr utils.NetAddr, hangoutID string,
 	return a, nil
 }
 
-// Start starts agent that attempts to connect to remote server part
-func (a *Agent) Start() error {
-	if err := a.reconnect(); err != nil {
+// Start starts agent that attempts to connect to remote server part. The
+// agent runs until ctx is canceled, at which point it stops reconnecting
+// and tears down its current connection, if any.
+func (a *Agent) Start(ctx context.Context) error {
+	if err := a.reconnect(ctx); err != nil {
 		return trace.Wrap(err)
 	}
-	go a.handleDisconnect()
+	go a.handleDisconnect(ctx)
 	return nil
 }
 
-func (a *Agent) handleDisconnect() {
+func (a *Agent) handleDisconnect(ctx context.Context) {
 	a.log.Infof("handle disconnects")
 	for {
 		select {
+		case <-ctx.Done():
+			a.log.Infof("context done, stopping reconnect loop")
+			return
 		case <-a.disconnectC:
 			a.log.Infof("detected disconnect, reconnecting")
-			a.reconnect()
+			a.reconnect(ctx)
 		}
 	}
 }
 
-func (a *Agent) reconnect() error {
+func (a *Agent) reconnect(ctx context.Context) error {
 	var err error
 	i := 0
 	for {
+		if ctx.Err() != nil {
+			return trace.Wrap(ctx.Err())
+		}
 		i++
-		if err = a.connect(); err != nil {
+		if err = a.connect(ctx); err != nil {
 			a.log.Infof("connect attempt %v: %v", i, err)
-			time.Sleep(time.Duration(min(i, 10)) * time.Second)
+			select {
+			case <-ctx.Done():
+				return trace.Wrap(ctx.Err())
+			case <-time.After(time.Duration(min(i, 10)) * time.Second):
+			}
 			continue
 		}
 		return nil
@@ -195,7 +219,7 @@ func (a *Agent) checkHostSignature(hostport string, remote net.Addr, key ssh.Pub
 	})
 }
 
-func (a *Agent) connect() error {
+func (a *Agent) connect(ctx context.Context) error {
 	if a.addr.IsEmpty() {
 		err := trace.Wrap(
 			teleport.BadParameter("addr",
@@ -224,9 +248,16 @@ func (a *Agent) connect() error {
 
 	a.conn = c
 
-	go a.startHeartbeat()
+	go func() {
+		<-ctx.Done()
+		a.log.Infof("context done, closing connection")
+		c.Close()
+	}()
+
+	go a.startControlStream(ctx)
 	go a.handleAccessPoint(c.HandleChannelOpen(chanAccessPoint))
 	go a.handleTransport(c.HandleChannelOpen(chanTransport))
+	go a.startL3Tunnel(c)
 
 	a.log.Infof("connection established")
 	return nil
@@ -318,6 +349,9 @@ func (a *Agent) proxyTransport(ch ssh.Channel, reqC <-chan *ssh.Request) {
 
 	a.log.Infof("successfully dialed to %v, start proxying", server)
 
+	a.addOpenTransport(1)
+	defer a.addOpenTransport(-1)
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
@@ -334,67 +368,19 @@ func (a *Agent) proxyTransport(ch ssh.Channel, reqC <-chan *ssh.Request) {
 	wg.Wait()
 }
 
-func (a *Agent) startHeartbeat() {
-	defer func() {
-		a.disconnectC <- true
-		a.log.Infof("sent disconnect message")
-	}()
-
-	hb, reqC, err := a.conn.OpenChannel(chanHeartbeat, nil)
-	if err != nil {
-		a.log.Errorf("failed to open channel: %v", err)
-		return
-	}
-
-	closeC := make(chan bool)
-	errC := make(chan error, 2)
-
-	go func() {
-		for {
-			select {
-			case <-closeC:
-				a.log.Infof("asked to exit")
-				return
-			default:
-			}
-			_, err := hb.SendRequest("ping", false, nil)
-			if err != nil {
-				a.log.Errorf("failed to send heartbeat: %v", err)
-				errC <- err
-				return
-			}
-			time.Sleep(heartbeatPeriod)
-		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-closeC:
-				log.Infof("asked to exit")
-				return
-			case req := <-reqC:
-				if req == nil {
-					errC <- trace.Errorf("heartbeat: connection closed")
-					return
-				}
-				a.log.Infof("got out of band request: %v", req)
-			}
-		}
-	}()
-
-	a.log.Infof("got error: %v", <-errC)
-	close(closeC)
-}
-
 const (
-	chanHeartbeat   = "teleport-heartbeat"
+	chanControl     = "teleport-control"
 	chanAccessPoint = "teleport-access-point"
 	chanTransport   = "teleport-transport"
 
 	chanTransportDialReq = "teleport-transport-dial"
 
-	heartbeatPeriod = 5 * time.Second
+	chanL3Tunnel = "teleport-transport-l3"
+	l3MTURequest = "mtu"
+
+	// defaultHeartbeatPeriod is how often the agent streams an AgentStatus
+	// message on the control stream before the proxy has told it otherwise.
+	defaultHeartbeatPeriod = 5 * time.Second
 )
 
 const (
@@ -406,6 +392,14 @@ const (
 	RemoteSiteStatusOnline = "online"
 )
 
+// addOpenTransport adjusts the count of open transport channels reported
+// in the agent's AgentStatus messages.
+func (a *Agent) addOpenTransport(delta int32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.openTransports += delta
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
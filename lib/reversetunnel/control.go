@@ -0,0 +1,209 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+
+	"github.com/gravitational/teleport/lib/reversetunnel/controlpb"
+)
+
+// channelConn adapts an ssh.Channel to a net.Conn so it can be used as the
+// transport for a gRPC connection. ssh.Channel already behaves like a
+// stream, it just doesn't implement the net.Conn methods gRPC needs for
+// deadlines and addressing. The deadline methods are no-ops here since the
+// channel is multiplexed over an SSH connection that has no per-channel
+// deadlines, and LocalAddr/RemoteAddr return whatever addresses the caller
+// supplied, since the channel has no addresses of its own.
+type channelConn struct {
+	ssh.Channel
+	laddr net.Addr
+	raddr net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.laddr }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// startControlStream opens the teleport-control SSH channel, dials a gRPC
+// connection over it, and runs the bidirectional AgentStatus/ProxyCommand
+// stream until ctx is canceled or the stream breaks. It replaces the old
+// unstructured "ping" heartbeat: the proxy now derives online/offline state
+// from the cadence of AgentStatus messages, and can push ProxyCommand
+// messages down the same stream instead of needing a new SSH channel per
+// command.
+func (a *Agent) startControlStream(ctx context.Context) {
+	defer func() {
+		a.disconnectC <- true
+		a.log.Infof("sent disconnect message")
+	}()
+
+	ch, reqC, err := a.conn.OpenChannel(chanControl, nil)
+	if err != nil {
+		a.log.Errorf("failed to open control channel: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqC)
+
+	cc, err := grpc.DialContext(ctx, chanControl,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return &channelConn{Channel: ch, laddr: a.addr, raddr: a.addr}, nil
+		}),
+	)
+	if err != nil {
+		a.log.Errorf("failed to dial control stream: %v", err)
+		return
+	}
+	defer cc.Close()
+
+	client := controlpb.NewAgentControlClient(cc)
+	stream, err := client.Control(ctx)
+	if err != nil {
+		a.log.Errorf("failed to open control stream: %v", err)
+		return
+	}
+
+	errC := make(chan error, 2)
+	go a.sendAgentStatus(ctx, stream, errC)
+	go a.recvProxyCommands(stream, errC)
+
+	select {
+	case <-ctx.Done():
+		a.log.Infof("control stream context done: %v", ctx.Err())
+	case err := <-errC:
+		a.log.Infof("control stream stopped: %v", err)
+	}
+}
+
+// sendAgentStatus streams an AgentStatus message every heartbeatPeriod
+// until ctx is canceled or the send fails. The period is read fresh on
+// every tick so an ADJUST_HEARTBEAT_PERIOD command from the proxy takes
+// effect without restarting the stream.
+func (a *Agent) sendAgentStatus(ctx context.Context, stream controlpb.AgentControl_ControlClient, errC chan<- error) {
+	start := time.Now()
+	for {
+		status := &controlpb.AgentStatus{
+			Version:        teleport.Version,
+			RemoteSite:     a.domainName,
+			UptimeSeconds:  int64(time.Since(start).Seconds()),
+			OpenTransports: a.transportCount(),
+			LoadAverage:    loadAverage(),
+		}
+		if err := stream.Send(status); err != nil {
+			errC <- trace.Wrap(err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			errC <- ctx.Err()
+			return
+		case <-time.After(a.getHeartbeatPeriod()):
+		}
+	}
+}
+
+// recvProxyCommands reads ProxyCommand messages pushed by the proxy and
+// acts on them until the stream ends or the proxy sends REQUEST_RECONNECT
+// or DRAIN.
+func (a *Agent) recvProxyCommands(stream controlpb.AgentControl_ControlClient, errC chan<- error) {
+	for {
+		cmd, err := stream.Recv()
+		if err != nil {
+			errC <- trace.Wrap(err)
+			return
+		}
+		a.log.Infof("got proxy command: %v", cmd.Type)
+		switch cmd.Type {
+		case controlpb.ProxyCommand_ADJUST_HEARTBEAT_PERIOD:
+			a.setHeartbeatPeriod(time.Duration(cmd.HeartbeatPeriodSeconds) * time.Second)
+		case controlpb.ProxyCommand_ROTATE_CA:
+			// TODO: wire this up to auth.TunClient once there's a way to
+			// reload host/user CAs on a live agent without a reconnect.
+			a.log.Infof("ca rotation requested, not yet implemented")
+		case controlpb.ProxyCommand_REQUEST_TRANSPORT_STATS:
+			// TODO: report transport stats back to the proxy once the
+			// control stream has a response message to carry them in.
+			a.log.Infof("transport stats requested, not yet implemented")
+		case controlpb.ProxyCommand_REQUEST_RECONNECT:
+			errC <- trace.Errorf("proxy requested reconnect")
+			return
+		case controlpb.ProxyCommand_DRAIN:
+			errC <- trace.Errorf("proxy requested drain")
+			return
+		}
+	}
+}
+
+// loadAverage returns the host's 1-minute load average, or 0 if it can't
+// be read (e.g. non-Linux, or /proc unavailable).
+func loadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	avg, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return avg
+}
+
+// getHeartbeatPeriod returns the current, possibly proxy-adjusted,
+// heartbeat period.
+func (a *Agent) getHeartbeatPeriod() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.heartbeatPeriod
+}
+
+// setHeartbeatPeriod updates the heartbeat period in response to an
+// ADJUST_HEARTBEAT_PERIOD command from the proxy.
+func (a *Agent) setHeartbeatPeriod(period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.log.Infof("proxy adjusted heartbeat period to %v", period)
+	a.heartbeatPeriod = period
+}
+
+// transportCount returns the number of transport channels the agent is
+// currently proxying.
+func (a *Agent) transportCount() int32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.openTransports
+}
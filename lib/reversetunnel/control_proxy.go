@@ -0,0 +1,218 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+
+	"github.com/gravitational/teleport/lib/reversetunnel/controlpb"
+	"github.com/gravitational/teleport/lib/utils"
+)
+
+// missedStatusTimeout is how long the proxy will wait without an
+// AgentStatus message before considering a site offline. It should be a
+// few multiples of the heartbeat period agents start with, so a couple of
+// skipped sends don't flap the site's status.
+const missedStatusTimeout = 3 * defaultHeartbeatPeriod
+
+// ControlServer is the proxy-side counterpart to Agent's control stream:
+// it implements controlpb.AgentControlServer over a single agent's
+// teleport-control channel, derives RemoteSiteStatusOnline/Offline from
+// the cadence of the agent's AgentStatus messages rather than raw ping
+// replies, and lets the proxy push ProxyCommands down to the agent. The
+// proxy's SSH server should call HandleChannel for every nch whose
+// ChannelType() is chanControl.
+type ControlServer struct {
+	log *log.Entry
+
+	mu         sync.Mutex
+	status     string
+	lastStatus *controlpb.AgentStatus
+	lastSeen   time.Time
+
+	commandC chan *controlpb.ProxyCommand
+	doneC    chan struct{}
+}
+
+// NewControlServer returns a control server for a single agent connection.
+func NewControlServer() *ControlServer {
+	return &ControlServer{
+		log:      log.WithFields(log.Fields{"module": "controlproxy"}),
+		status:   RemoteSiteStatusOffline,
+		commandC: make(chan *controlpb.ProxyCommand, 10),
+		doneC:    make(chan struct{}),
+	}
+}
+
+// HandleChannel terminates a single teleport-control channel opened by an
+// agent: it runs a gRPC server over the channel (via a one-shot
+// net.Listener wrapping the already-open ssh.Channel) until the channel or
+// the control stream ends.
+func (s *ControlServer) HandleChannel(nch ssh.NewChannel) {
+	ch, reqC, err := nch.Accept()
+	if err != nil {
+		s.log.Errorf("failed to accept control channel: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqC)
+
+	gs := grpc.NewServer()
+	controlpb.RegisterAgentControlServer(gs, s)
+
+	// channelConn has no real local/remote address (it wraps an already
+	// open ssh.Channel), but grpc.Server.Serve calls Addr().String() on
+	// every accepted connection, so laddr/raddr must not be left nil.
+	lis := newChannelListener(&channelConn{Channel: ch, laddr: utils.NetAddr{}, raddr: utils.NetAddr{}})
+
+	// channelListener only ever has the one connection to give out, so
+	// left alone gs.Serve would block in Accept() forever once Control
+	// returns rather than noticing the connection is done. Stop the
+	// server as soon as Control says so, which unblocks Serve and lets
+	// the cleanup below run.
+	go func() {
+		<-s.doneC
+		gs.Stop()
+	}()
+	if err := gs.Serve(lis); err != nil {
+		s.log.Infof("control stream serve stopped: %v", err)
+	}
+	s.markOffline()
+}
+
+// Control implements controlpb.AgentControlServer: it receives AgentStatus
+// messages, updates the derived site status, and streams out any
+// ProxyCommands queued for this agent via PushCommand.
+func (s *ControlServer) Control(stream controlpb.AgentControl_ControlServer) error {
+	errC := make(chan error, 2)
+	go s.recvStatus(stream, errC)
+	go s.sendCommands(stream, errC)
+	err := <-errC
+	close(s.doneC)
+	return err
+}
+
+func (s *ControlServer) recvStatus(stream controlpb.AgentControl_ControlServer, errC chan<- error) {
+	for {
+		status, err := stream.Recv()
+		if err != nil {
+			s.markOffline()
+			errC <- trace.Wrap(err)
+			return
+		}
+		s.mu.Lock()
+		s.status = RemoteSiteStatusOnline
+		s.lastStatus = status
+		s.lastSeen = time.Now()
+		s.mu.Unlock()
+	}
+}
+
+func (s *ControlServer) sendCommands(stream controlpb.AgentControl_ControlServer, errC chan<- error) {
+	for {
+		select {
+		case cmd := <-s.commandC:
+			if err := stream.Send(cmd); err != nil {
+				errC <- trace.Wrap(err)
+				return
+			}
+		case <-stream.Context().Done():
+			return
+		}
+	}
+}
+
+// PushCommand queues cmd to be sent to the agent over its control stream.
+func (s *ControlServer) PushCommand(cmd *controlpb.ProxyCommand) {
+	s.commandC <- cmd
+}
+
+// Status returns RemoteSiteStatusOnline if the agent's last AgentStatus
+// arrived within missedStatusTimeout, RemoteSiteStatusOffline otherwise -
+// derived from missed status messages rather than a raw ping reply.
+func (s *ControlServer) Status() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == RemoteSiteStatusOnline && time.Since(s.lastSeen) > missedStatusTimeout {
+		s.status = RemoteSiteStatusOffline
+	}
+	return s.status
+}
+
+// LastStatus returns the most recently received AgentStatus, or nil if the
+// agent has never sent one.
+func (s *ControlServer) LastStatus() *controlpb.AgentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastStatus
+}
+
+func (s *ControlServer) markOffline() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = RemoteSiteStatusOffline
+}
+
+// channelListener is a net.Listener that yields a single, already
+// established net.Conn and then blocks until closed. It lets a
+// *grpc.Server run over a channel that's already open rather than a real
+// listening socket.
+type channelListener struct {
+	conn    net.Conn
+	acceptC chan net.Conn
+	closeC  chan struct{}
+	once    sync.Once
+}
+
+func newChannelListener(conn net.Conn) *channelListener {
+	l := &channelListener{
+		conn:    conn,
+		acceptC: make(chan net.Conn, 1),
+		closeC:  make(chan struct{}),
+	}
+	l.acceptC <- conn
+	return l
+}
+
+func (l *channelListener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-l.acceptC:
+		if !ok {
+			return nil, io.EOF
+		}
+		return conn, nil
+	case <-l.closeC:
+		return nil, io.EOF
+	}
+}
+
+func (l *channelListener) Close() error {
+	l.once.Do(func() { close(l.closeC) })
+	return nil
+}
+
+func (l *channelListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
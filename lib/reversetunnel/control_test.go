@@ -0,0 +1,122 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/gravitational/teleport/lib/reversetunnel/controlpb"
+)
+
+func newTestAgent() *Agent {
+	return &Agent{
+		log:             log.WithFields(log.Fields{"module": "test"}),
+		disconnectC:     make(chan bool, 10),
+		heartbeatPeriod: defaultHeartbeatPeriod,
+	}
+}
+
+// fakeControlClient is a minimal AgentControl_ControlClient that replays a
+// fixed sequence of ProxyCommands and then reports the stream as closed.
+type fakeControlClient struct {
+	grpc.ClientStream
+	cmds []*controlpb.ProxyCommand
+	idx  int
+}
+
+func (f *fakeControlClient) Send(*controlpb.AgentStatus) error { return nil }
+
+func (f *fakeControlClient) Recv() (*controlpb.ProxyCommand, error) {
+	if f.idx >= len(f.cmds) {
+		return nil, io.EOF
+	}
+	cmd := f.cmds[f.idx]
+	f.idx++
+	return cmd, nil
+}
+
+func TestGetSetHeartbeatPeriod(t *testing.T) {
+	a := newTestAgent()
+	if got := a.getHeartbeatPeriod(); got != defaultHeartbeatPeriod {
+		t.Fatalf("got %v, want default %v", got, defaultHeartbeatPeriod)
+	}
+
+	a.setHeartbeatPeriod(30 * time.Second)
+	if got := a.getHeartbeatPeriod(); got != 30*time.Second {
+		t.Fatalf("got %v, want 30s", got)
+	}
+}
+
+func TestSetHeartbeatPeriodIgnoresNonPositive(t *testing.T) {
+	a := newTestAgent()
+
+	a.setHeartbeatPeriod(0)
+	if got := a.getHeartbeatPeriod(); got != defaultHeartbeatPeriod {
+		t.Fatalf("0 period should be ignored, got %v", got)
+	}
+
+	a.setHeartbeatPeriod(-time.Second)
+	if got := a.getHeartbeatPeriod(); got != defaultHeartbeatPeriod {
+		t.Fatalf("negative period should be ignored, got %v", got)
+	}
+}
+
+func TestRecvProxyCommandsAdjustsHeartbeatPeriod(t *testing.T) {
+	a := newTestAgent()
+	client := &fakeControlClient{cmds: []*controlpb.ProxyCommand{
+		{Type: controlpb.ProxyCommand_ADJUST_HEARTBEAT_PERIOD, HeartbeatPeriodSeconds: 42},
+	}}
+	errC := make(chan error, 1)
+
+	a.recvProxyCommands(client, errC)
+
+	if got := a.getHeartbeatPeriod(); got != 42*time.Second {
+		t.Fatalf("got %v, want 42s", got)
+	}
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatalf("expected non-nil error once the stream ends")
+		}
+	default:
+		t.Fatalf("expected recvProxyCommands to report the closed stream")
+	}
+}
+
+func TestRecvProxyCommandsStopsOnDrain(t *testing.T) {
+	a := newTestAgent()
+	client := &fakeControlClient{cmds: []*controlpb.ProxyCommand{
+		{Type: controlpb.ProxyCommand_DRAIN},
+	}}
+	errC := make(chan error, 1)
+
+	a.recvProxyCommands(client, errC)
+
+	select {
+	case err := <-errC:
+		if err == nil {
+			t.Fatalf("expected a drain error")
+		}
+	default:
+		t.Fatalf("expected recvProxyCommands to report the drain request")
+	}
+}
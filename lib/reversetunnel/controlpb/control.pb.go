@@ -0,0 +1,239 @@
+// Package controlpb contains the message types and gRPC service for the
+// reversetunnel control stream, defined in control.proto.
+//
+// This file is hand-maintained, not protoc-generated, since this tree
+// doesn't have protoc-gen-go/protoc-gen-go-grpc available. If it's ever
+// regenerated from control.proto, this file should be replaced outright
+// with the real generated output rather than hand-merged.
+package controlpb
+
+import (
+	context "context"
+	fmt "fmt"
+
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+
+// ProxyCommand_Type is the kind of command the proxy is pushing to the
+// agent over the control stream.
+type ProxyCommand_Type int32
+
+const (
+	ProxyCommand_UNKNOWN                 ProxyCommand_Type = 0
+	ProxyCommand_REQUEST_RECONNECT       ProxyCommand_Type = 1
+	ProxyCommand_ROTATE_CA               ProxyCommand_Type = 2
+	ProxyCommand_ADJUST_HEARTBEAT_PERIOD ProxyCommand_Type = 3
+	ProxyCommand_REQUEST_TRANSPORT_STATS ProxyCommand_Type = 4
+	ProxyCommand_DRAIN                   ProxyCommand_Type = 5
+)
+
+var ProxyCommand_Type_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "REQUEST_RECONNECT",
+	2: "ROTATE_CA",
+	3: "ADJUST_HEARTBEAT_PERIOD",
+	4: "REQUEST_TRANSPORT_STATS",
+	5: "DRAIN",
+}
+
+var ProxyCommand_Type_value = map[string]int32{
+	"UNKNOWN":                 0,
+	"REQUEST_RECONNECT":       1,
+	"ROTATE_CA":               2,
+	"ADJUST_HEARTBEAT_PERIOD": 3,
+	"REQUEST_TRANSPORT_STATS": 4,
+	"DRAIN":                   5,
+}
+
+func (x ProxyCommand_Type) String() string {
+	return proto.EnumName(ProxyCommand_Type_name, int32(x))
+}
+
+// AgentStatus is sent periodically by the agent to report its own health
+// and the work it is doing.
+type AgentStatus struct {
+	Version        string  `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
+	RemoteSite     string  `protobuf:"bytes,2,opt,name=remote_site,json=remoteSite" json:"remote_site,omitempty"`
+	UptimeSeconds  int64   `protobuf:"varint,3,opt,name=uptime_seconds,json=uptimeSeconds" json:"uptime_seconds,omitempty"`
+	OpenTransports int32   `protobuf:"varint,4,opt,name=open_transports,json=openTransports" json:"open_transports,omitempty"`
+	LoadAverage    float64 `protobuf:"fixed64,5,opt,name=load_average,json=loadAverage" json:"load_average,omitempty"`
+}
+
+func (m *AgentStatus) Reset()         { *m = AgentStatus{} }
+func (m *AgentStatus) String() string { return proto.CompactTextString(m) }
+func (*AgentStatus) ProtoMessage()    {}
+
+func (m *AgentStatus) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *AgentStatus) GetRemoteSite() string {
+	if m != nil {
+		return m.RemoteSite
+	}
+	return ""
+}
+
+func (m *AgentStatus) GetUptimeSeconds() int64 {
+	if m != nil {
+		return m.UptimeSeconds
+	}
+	return 0
+}
+
+func (m *AgentStatus) GetOpenTransports() int32 {
+	if m != nil {
+		return m.OpenTransports
+	}
+	return 0
+}
+
+func (m *AgentStatus) GetLoadAverage() float64 {
+	if m != nil {
+		return m.LoadAverage
+	}
+	return 0
+}
+
+// ProxyCommand is pushed by the proxy down the control stream to tell the
+// agent to take some action.
+type ProxyCommand struct {
+	Type                   ProxyCommand_Type `protobuf:"varint,1,opt,name=type,enum=controlpb.ProxyCommand_Type" json:"type,omitempty"`
+	HeartbeatPeriodSeconds int64             `protobuf:"varint,2,opt,name=heartbeat_period_seconds,json=heartbeatPeriodSeconds" json:"heartbeat_period_seconds,omitempty"`
+}
+
+func (m *ProxyCommand) Reset()         { *m = ProxyCommand{} }
+func (m *ProxyCommand) String() string { return proto.CompactTextString(m) }
+func (*ProxyCommand) ProtoMessage()    {}
+
+func (m *ProxyCommand) GetType() ProxyCommand_Type {
+	if m != nil {
+		return m.Type
+	}
+	return ProxyCommand_UNKNOWN
+}
+
+func (m *ProxyCommand) GetHeartbeatPeriodSeconds() int64 {
+	if m != nil {
+		return m.HeartbeatPeriodSeconds
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterEnum("controlpb.ProxyCommand_Type", ProxyCommand_Type_name, ProxyCommand_Type_value)
+	proto.RegisterType((*AgentStatus)(nil), "controlpb.AgentStatus")
+	proto.RegisterType((*ProxyCommand)(nil), "controlpb.ProxyCommand")
+}
+
+// AgentControlClient is the client API for AgentControl service.
+type AgentControlClient interface {
+	Control(ctx context.Context, opts ...grpc.CallOption) (AgentControl_ControlClient, error)
+}
+
+type agentControlClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewAgentControlClient returns a client for the AgentControl service bound
+// to cc. cc is typically dialed with a custom dialer that hands back an
+// already-open net.Conn wrapping the teleport-control SSH channel, rather
+// than opening a new network connection.
+func NewAgentControlClient(cc *grpc.ClientConn) AgentControlClient {
+	return &agentControlClient{cc}
+}
+
+func (c *agentControlClient) Control(ctx context.Context, opts ...grpc.CallOption) (AgentControl_ControlClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_AgentControl_serviceDesc.Streams[0], "/controlpb.AgentControl/Control", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentControlControlClient{stream}
+	return x, nil
+}
+
+// AgentControl_ControlClient is the agent's view of the Control stream: it
+// sends AgentStatus messages and receives ProxyCommand messages.
+type AgentControl_ControlClient interface {
+	Send(*AgentStatus) error
+	Recv() (*ProxyCommand, error)
+	grpc.ClientStream
+}
+
+type agentControlControlClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentControlControlClient) Send(m *AgentStatus) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentControlControlClient) Recv() (*ProxyCommand, error) {
+	m := new(ProxyCommand)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AgentControlServer is the server API for AgentControl service.
+type AgentControlServer interface {
+	Control(AgentControl_ControlServer) error
+}
+
+// AgentControl_ControlServer is the proxy's view of the Control stream: it
+// receives AgentStatus messages and sends ProxyCommand messages.
+type AgentControl_ControlServer interface {
+	Send(*ProxyCommand) error
+	Recv() (*AgentStatus, error)
+	grpc.ServerStream
+}
+
+type agentControlControlServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentControlControlServer) Send(m *ProxyCommand) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentControlControlServer) Recv() (*AgentStatus, error) {
+	m := new(AgentStatus)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _AgentControl_Control_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentControlServer).Control(&agentControlControlServer{stream})
+}
+
+// RegisterAgentControlServer registers srv, the proxy's implementation of
+// the control stream, with s.
+func RegisterAgentControlServer(s *grpc.Server, srv AgentControlServer) {
+	s.RegisterService(&_AgentControl_serviceDesc, srv)
+}
+
+var _AgentControl_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "controlpb.AgentControl",
+	HandlerType: (*AgentControlServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Control",
+			Handler:       _AgentControl_Control_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
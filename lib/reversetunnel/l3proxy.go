@@ -0,0 +1,121 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// L3TunnelServer is the proxy-side counterpart to Agent's L3 tunnel: it
+// terminates teleport-transport-l3 channels opened by agents, bringing up
+// its own TUN device per site CIDR and forwarding IP traffic between it and
+// the agent's channel. The proxy's SSH server should call HandleChannel for
+// every nch whose ChannelType() is chanL3Tunnel.
+type L3TunnelServer struct {
+	log *log.Entry
+	mtu int
+}
+
+// NewL3TunnelServer returns a server that terminates agent L3 tunnels,
+// advertising mtu as the negotiated MTU for every site.
+func NewL3TunnelServer(mtu int) (*L3TunnelServer, error) {
+	if err := validateL3MTU(mtu); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &L3TunnelServer{
+		log: log.WithFields(log.Fields{"module": "l3proxy"}),
+		mtu: mtu,
+	}, nil
+}
+
+// HandleChannel terminates a single teleport-transport-l3 channel opened by
+// an agent: it accepts the channel, negotiates the MTU, brings up a TUN
+// device for the site CIDR carried in the channel's extra data, and pumps
+// IP packets between the device and the channel until either goes away.
+func (s *L3TunnelServer) HandleChannel(nch ssh.NewChannel) {
+	cidr := string(nch.ExtraData())
+	ch, reqC, err := nch.Accept()
+	if err != nil {
+		s.log.Errorf("failed to accept l3 tunnel channel: %v", err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqC)
+
+	if err := s.negotiateMTU(ch); err != nil {
+		s.log.Errorf("l3 tunnel mtu negotiation failed: %v", err)
+		return
+	}
+
+	ifaceName := l3ProxyIfaceName(cidr)
+	iface, err := bringUpTunDevice(cidr, ifaceName, s.mtu)
+	if err != nil {
+		s.log.Errorf("failed to bring up tun device %v: %v", ifaceName, err)
+		return
+	}
+	defer func() {
+		s.log.Infof("tearing down tun device %v", iface.Name())
+		iface.Close()
+	}()
+
+	s.log.Infof("l3 tunnel up, routing %v over %v", cidr, ifaceName)
+
+	errC := make(chan error, 2)
+
+	go func() {
+		errC <- pumpFramesToTun(ch, iface, s.mtu)
+	}()
+
+	go func() {
+		errC <- pumpFramesFromTun(iface, ch, s.mtu)
+	}()
+
+	s.log.Infof("l3 tunnel stopped: %v", <-errC)
+}
+
+// negotiateMTU sends the proxy's out-of-band "mtu" request down ch,
+// mirroring what Agent.negotiateL3MTU waits for, and fails if the agent
+// rejects it (e.g. because it's out of the range validateL3MTU allows).
+func (s *L3TunnelServer) negotiateMTU(ch ssh.Channel) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(s.mtu))
+	ok, err := ch.SendRequest(l3MTURequest, true, payload)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !ok {
+		return trace.Errorf("agent rejected mtu %v", s.mtu)
+	}
+	return nil
+}
+
+// l3ProxyIfaceName derives a short, deterministic TUN device name from
+// cidr, so the proxy can run one tunnel per site without name collisions.
+// The result is truncated to 6 hex digits so it always fits Linux's
+// IFNAMSIZ-1 (15-char) interface name limit, unlike a full, unpadded
+// %x of the hash which can run to 16 characters.
+func l3ProxyIfaceName(cidr string) string {
+	h := fnv.New32a()
+	h.Write([]byte(cidr))
+	return fmt.Sprintf("tele-l3-%06x", h.Sum32()&0xffffff)
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/crypto/ssh"
+)
+
+// SetL3Tunnel configures the agent to bring up a local TUN device once the
+// reverse tunnel is established, and to forward any IP traffic destined for
+// cidr to the proxy over a dedicated SSH channel instead of requiring a
+// separate per-connection dial. ifaceName names the TUN device to create,
+// e.g. "tele0".
+func SetL3Tunnel(cidr string, ifaceName string) AgentOption {
+	return func(a *Agent) error {
+		a.l3CIDR = cidr
+		a.l3IfaceName = ifaceName
+		return nil
+	}
+}
+
+// startL3Tunnel opens the L3 tunneling channel, brings up a local TUN
+// device routing l3CIDR, and pumps IP packets between the device and the
+// channel until the connection goes away. It is started once per connect()
+// alongside the control stream and transport channels, given the same
+// ssh.Conn connect() just established.
+//
+// L3 tunneling is opt-in and best-effort: unlike the control stream, a
+// failure to bring it up (no CAP_NET_ADMIN, a bad
+// CIDR, or a proxy that doesn't speak teleport-transport-l3 yet) does not
+// push to disconnectC, since that would tear down the whole SSH connection
+// and put the agent into a reconnect loop over a problem a reconnect can't
+// fix.
+func (a *Agent) startL3Tunnel(conn ssh.Conn) {
+	if a.l3CIDR == "" {
+		return
+	}
+
+	ch, reqC, err := conn.OpenChannel(chanL3Tunnel, []byte(a.l3CIDR))
+	if err != nil {
+		a.log.Errorf("failed to open l3 tunnel channel: %v", err)
+		return
+	}
+	defer ch.Close()
+
+	mtu, err := a.negotiateL3MTU(reqC)
+	if err != nil {
+		a.log.Errorf("l3 tunnel mtu negotiation failed: %v", err)
+		return
+	}
+
+	iface, err := bringUpTunDevice(a.l3CIDR, a.l3IfaceName, mtu)
+	if err != nil {
+		a.log.Errorf("failed to bring up tun device %v: %v", a.l3IfaceName, err)
+		return
+	}
+	defer a.tearDownTunDevice(iface)
+
+	a.log.Infof("l3 tunnel up, routing %v over %v", a.l3CIDR, a.l3IfaceName)
+
+	errC := make(chan error, 2)
+
+	go func() {
+		errC <- pumpFramesToTun(ch, iface, mtu)
+	}()
+
+	go func() {
+		errC <- pumpFramesFromTun(iface, ch, mtu)
+	}()
+
+	a.log.Infof("l3 tunnel stopped: %v", <-errC)
+}
+
+const (
+	// minL3MTU is the smallest MTU we'll negotiate for an L3 tunnel: below
+	// this, a standard IPv4 packet wouldn't even fit unfragmented.
+	minL3MTU = 576
+	// maxL3MTU is the largest MTU we'll negotiate. The per-packet length
+	// prefix written by writeFrame/read by readFrame is a uint16, so
+	// anything bigger than that can't be framed without truncating.
+	maxL3MTU = 65535
+)
+
+// validateL3MTU rejects MTUs that are too small to carry an IP packet or
+// too large to fit in the uint16 frame length prefix.
+func validateL3MTU(mtu int) error {
+	if mtu < minL3MTU || mtu > maxL3MTU {
+		return trace.Errorf("mtu %v out of allowed range [%v, %v]", mtu, minL3MTU, maxL3MTU)
+	}
+	return nil
+}
+
+// negotiateL3MTU waits for the proxy's out-of-band "mtu" request, which
+// carries the negotiated MTU for the tunnel as a big-endian uint32, and
+// acknowledges it. The proxy sends the MTU it was configured with in
+// NewL3TunnelServer, mirroring how proxyTransport waits on the dial
+// request before proxying. The payload is untrusted, so the MTU is
+// range-checked before it's used to size any buffers.
+func (a *Agent) negotiateL3MTU(reqC <-chan *ssh.Request) (int, error) {
+	var req *ssh.Request
+	select {
+	case req = <-reqC:
+		if req == nil {
+			return 0, trace.Errorf("connection closed, returning")
+		}
+	case <-time.After(10 * time.Second):
+		return 0, trace.Errorf("timeout waiting for mtu negotiation")
+	}
+	if req.Type != l3MTURequest || len(req.Payload) != 4 {
+		req.Reply(false, nil)
+		return 0, trace.Errorf("unexpected request %v during mtu negotiation", req.Type)
+	}
+	mtu := int(binary.BigEndian.Uint32(req.Payload))
+	if err := validateL3MTU(mtu); err != nil {
+		req.Reply(false, nil)
+		return 0, trace.Wrap(err)
+	}
+	req.Reply(true, nil)
+	return mtu, nil
+}
+
+// bringUpTunDevice creates ifaceName as a TUN device, gives it a host
+// address out of cidr, and adds a route for the whole CIDR through it so
+// packets destined for that network actually get sent to the device
+// instead of just labelling the device with the network's own address.
+// It's shared by the agent, which brings up a device for its own site, and
+// the proxy, which brings up one per site it's tunneling for.
+func bringUpTunDevice(cidr, ifaceName string, mtu int) (*water.Interface, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	iface, err := water.New(water.Config{
+		DeviceType: water.TUN,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name: ifaceName,
+		},
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	link, err := netlink.LinkByName(iface.Name())
+	if err != nil {
+		iface.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	hostAddr := &netlink.Addr{IPNet: &net.IPNet{IP: firstHostIP(ipNet), Mask: ipNet.Mask}}
+	if err := netlink.AddrAdd(link, hostAddr); err != nil {
+		iface.Close()
+		return nil, trace.Wrap(err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		iface.Close()
+		return nil, trace.Wrap(err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		iface.Close()
+		return nil, trace.Wrap(err)
+	}
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: ipNet}); err != nil {
+		iface.Close()
+		return nil, trace.Wrap(err)
+	}
+	return iface, nil
+}
+
+// firstHostIP returns the first usable host address in ipNet (the network
+// address plus one), used to give the TUN device itself an address
+// distinct from the network address netlink.RouteAdd routes through it.
+func firstHostIP(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		ip = ipNet.IP.To16()
+	}
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i]++
+		if out[i] != 0 {
+			break
+		}
+	}
+	return out
+}
+
+// tearDownTunDevice closes the TUN device, releasing its addresses and
+// routes back to the kernel.
+func (a *Agent) tearDownTunDevice(iface *water.Interface) {
+	a.log.Infof("tearing down tun device %v", iface.Name())
+	iface.Close()
+}
+
+// pumpFramesToTun reads length-prefixed IP packets off ch and writes them
+// to the TUN device.
+func pumpFramesToTun(ch ssh.Channel, iface *water.Interface, mtu int) error {
+	buf := make([]byte, mtu)
+	for {
+		packet, err := readFrame(ch, buf)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if _, err := iface.Write(packet); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
+// pumpFramesFromTun reads IP packets off the TUN device and writes them to
+// ch, each prefixed with its length so the far end can frame the stream.
+func pumpFramesFromTun(iface *water.Interface, ch ssh.Channel, mtu int) error {
+	buf := make([]byte, mtu)
+	for {
+		n, err := iface.Read(buf)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if err := writeFrame(ch, buf[:n]); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
+// frameHeaderSize is the length of the length-prefix written before every
+// packet on the l3 tunnel channel.
+const frameHeaderSize = 2
+
+// writeFrame writes b to w prefixed with its 16-bit big-endian length.
+func writeFrame(w io.Writer, b []byte) error {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+	if _, err := w.Write(header[:]); err != nil {
+		return trace.Wrap(err)
+	}
+	_, err := w.Write(b)
+	return trace.Wrap(err)
+}
+
+// readFrame reads a single length-prefixed packet from r into buf, which
+// must be large enough to hold the negotiated MTU (the frame header is
+// read separately, into its own array), and returns the packet payload.
+func readFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return nil, trace.Errorf("frame of %v bytes exceeds mtu buffer of %v bytes", n, len(buf))
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payload := []byte("hello world")
+
+	if err := writeFrame(&buf, payload); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	readBuf := make([]byte, len(payload))
+	packet, err := readFrame(&buf, readBuf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !bytes.Equal(packet, payload) {
+		t.Fatalf("got %q, want %q", packet, payload)
+	}
+}
+
+func TestReadFrameRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("0123456789")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	small := make([]byte, 4)
+	if _, err := readFrame(&buf, small); err == nil {
+		t.Fatalf("expected error reading a frame bigger than the buffer")
+	}
+}
+
+func TestFirstHostIP(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("10.8.0.0/24")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	host := firstHostIP(ipNet)
+	if !host.Equal(net.ParseIP("10.8.0.1")) {
+		t.Fatalf("got %v, want 10.8.0.1", host)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reversetunnel
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// ProxyHandlers dispatches the SSH channels an agent opens on its
+// connection to the proxy-side handler that understands each one. The
+// proxy's SSH server should call HandleNewChannel for every ssh.NewChannel
+// it receives on an agent's connection, the mirror image of how Agent
+// itself dispatches chanAccessPoint/chanTransport on its end.
+type ProxyHandlers struct {
+	// L3 terminates chanL3Tunnel channels, or nil if L3 tunneling isn't
+	// enabled for this proxy.
+	L3 *L3TunnelServer
+	// Control terminates chanControl channels, or nil if this proxy
+	// doesn't run the control stream for this agent's connection.
+	Control *ControlServer
+}
+
+// HandleNewChannel routes nch to the handler for its channel type,
+// rejecting it if no handler is configured for that type.
+func (p *ProxyHandlers) HandleNewChannel(nch ssh.NewChannel) {
+	switch nch.ChannelType() {
+	case chanL3Tunnel:
+		if p.L3 != nil {
+			p.L3.HandleChannel(nch)
+			return
+		}
+	case chanControl:
+		if p.Control != nil {
+			p.Control.HandleChannel(nch)
+			return
+		}
+	}
+	nch.Reject(ssh.UnknownChannelType, "unsupported channel type")
+}